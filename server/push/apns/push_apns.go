@@ -0,0 +1,262 @@
+// Package apns implements a push notification plugin which talks to Apple
+// Push Notification service directly over HTTP/2, using token-based (JWT)
+// provider authentication. It's meant for deployments which need iOS push
+// without routing through FCM, e.g. enterprise or China-region builds.
+// https://developer.apple.com/documentation/usernotifications/sending-notification-requests-to-apns
+package apns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// Apple requires provider tokens to be refreshed at least every hour.
+	tokenTTL = 55 * time.Minute
+
+	prodURL    = "https://api.push.apple.com/3/device/%s"
+	sandboxURL = "https://api.sandbox.push.apple.com/3/device/%s"
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+
+	client *http.Client
+
+	keyID  string
+	teamID string
+	topic  string
+	key    *ecdsa.PrivateKey
+	useURL string
+
+	mux         sync.Mutex
+	token       string
+	tokenIssued time.Time
+}
+
+type configType struct {
+	Enabled    bool   `json:"enabled"`
+	Sandbox    bool   `json:"sandbox"`
+	KeyID      string `json:"key_id"`
+	TeamID     string `json:"team_id"`
+	Topic      string `json:"topic"`
+	PrivateKey string `json:"private_key"`
+}
+
+// Init initializes the push handler.
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("apns: failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if config.KeyID == "" || config.TeamID == "" || config.Topic == "" || config.PrivateKey == "" {
+		return false, errors.New("apns: missing key_id, team_id, topic or private_key")
+	}
+
+	block, _ := pem.Decode([]byte(config.PrivateKey))
+	if block == nil {
+		return false, errors.New("apns: invalid private_key PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return false, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return false, errors.New("apns: private_key is not an ECDSA key")
+	}
+
+	handler.keyID = config.KeyID
+	handler.teamID = config.TeamID
+	handler.topic = config.Topic
+	handler.key = ecKey
+	handler.useURL = prodURL
+	if config.Sandbox {
+		handler.useURL = sandboxURL
+	}
+	// APNs requires HTTP/2; the standard client negotiates it automatically
+	// over TLS when the server supports it, which api.push.apple.com does.
+	handler.client = &http.Client{Timeout: 10 * time.Second}
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendApns(rcpt, &config)
+			case sub := <-handler.channel:
+				// Direct APNs has no concept of server-managed topics; subscription
+				// state lives entirely in the app via remote notifications.
+				logs.Warn.Println("apns: topic subscriptions not supported, uid", sub.Uid)
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// providerToken returns a cached JWT signed with the ES256 key, refreshing it
+// once it's older than tokenTTL as required by Apple's provider auth token policy.
+func providerToken() (string, error) {
+	handler.mux.Lock()
+	defer handler.mux.Unlock()
+
+	if handler.token != "" && time.Since(handler.tokenIssued) < tokenTTL {
+		return handler.token, nil
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": handler.teamID,
+		"iat": now.Unix(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = handler.keyID
+
+	signed, err := token.SignedString(handler.key)
+	if err != nil {
+		return "", err
+	}
+
+	handler.token = signed
+	handler.tokenIssued = now
+	return signed, nil
+}
+
+// apnsPayload is the minimal Apple-defined payload envelope. Per-notification
+// content lives under "aps".
+type apnsPayload struct {
+	Aps struct {
+		Alert struct {
+			Title string `json:"title,omitempty"`
+			Body  string `json:"body,omitempty"`
+		} `json:"alert"`
+	} `json:"aps"`
+}
+
+func sendApns(rcpt *push.Receipt, config *configType) {
+	tokens, uids := DevicesForReceipt(rcpt)
+	if len(tokens) == 0 {
+		return
+	}
+
+	authToken, err := providerToken()
+	if err != nil {
+		logs.Warn.Println("apns: failed to build provider token:", err)
+		return
+	}
+
+	var payload apnsPayload
+	payload.Aps.Alert.Title = rcpt.Payload.Topic
+	payload.Aps.Alert.Body = "New message"
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logs.Warn.Println("apns: failed to marshal payload:", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for i, deviceToken := range tokens {
+		sendOne(ctx, authToken, deviceToken, uids[i], body, config)
+	}
+}
+
+func sendOne(ctx context.Context, authToken, deviceToken string, uid types.Uid, body []byte, config *configType) {
+	url := fmt.Sprintf(handler.useURL, deviceToken)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		logs.Warn.Println("apns: failed to build request:", err)
+		return
+	}
+	req.Header.Set("authorization", "bearer "+authToken)
+	req.Header.Set("apns-topic", handler.topic)
+	req.Header.Set("apns-push-type", "alert")
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		logs.Warn.Println("apns: send failed:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return
+	}
+
+	var reason struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&reason)
+
+	switch reason.Reason {
+	case "BadDeviceToken", "Unregistered":
+		logs.Warn.Println("apns invalid token:", reason.Reason)
+		if err := store.Devices.Delete(uid, deviceToken); err != nil {
+			logs.Warn.Println("apns failed to delete invalid token:", err)
+		}
+	default:
+		logs.Warn.Println("apns send error:", resp.StatusCode, reason.Reason)
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices.
+// Direct APNs delivery has no server-side topic concept, so requests
+// received here are logged and dropped.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler.
+func (Handler) Stop() {
+	close(handler.stop)
+}
+
+func init() {
+	push.Register("apns", &handler)
+}
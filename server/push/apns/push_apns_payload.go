@@ -0,0 +1,36 @@
+package apns
+
+import (
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// DevicesForReceipt returns the APNs device tokens for every recipient of
+// rcpt that has a device registered with the "apns" provider, paired with
+// the owning Uid so a delivery failure can be mapped back to the right device.
+func DevicesForReceipt(rcpt *push.Receipt) ([]string, []types.Uid) {
+	uids := make([]types.Uid, 0, len(rcpt.To))
+	for uid := range rcpt.To {
+		uids = append(uids, uid)
+	}
+
+	devicesByUser, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		return nil, nil
+	}
+
+	var tokens []string
+	var owners []types.Uid
+	for i, uid := range uids {
+		for _, dev := range devicesByUser[i] {
+			if dev.Provider != "apns" {
+				continue
+			}
+			tokens = append(tokens, dev.DeviceId)
+			owners = append(owners, uid)
+		}
+	}
+
+	return tokens, owners
+}
@@ -0,0 +1,58 @@
+// Package common holds types shared by the push notification providers
+// (fcm, hms, apns, webpush): per-platform payload overrides layered on top
+// of a generic push.Payload when building the provider-specific notification.
+package common
+
+// Config carries the per-platform knobs read from the `android`, `apns` and
+// `webpush` blocks of a provider's config. A nil *Config means "use defaults
+// derived from the payload, with no platform-specific decoration".
+type Config struct {
+	// Enabled is parsed from the config block but not consulted by the fcm
+	// decoration code: a non-nil block is applied whether or not it's set.
+	Enabled bool `json:"enabled"`
+
+	// Localization. The client looks LocKey/TitleLocKey up in its own
+	// string tables and substitutes LocArgs/TitleLocArgs, so the server
+	// never needs to know the recipient's language.
+	LocKey       string   `json:"loc_key,omitempty"`
+	LocArgs      []string `json:"loc_args,omitempty"`
+	TitleLocKey  string   `json:"title_loc_key,omitempty"`
+	TitleLocArgs []string `json:"title_loc_args,omitempty"`
+
+	// MutableContent routes delivery through the client's
+	// notification-service-extension (iOS), e.g. to decrypt an encrypted
+	// message preview or attach a downloaded image before display.
+	MutableContent bool `json:"mutable_content,omitempty"`
+	// Category ties the notification to a client-registered
+	// UNNotificationCategory; on iOS the buttons shown are that category's.
+	Category string `json:"category,omitempty"`
+	// ThreadID groups related notifications together in the iOS notification center.
+	ThreadID string `json:"thread_id,omitempty"`
+
+	// ClickAction is the Android intent action fired when the user taps the notification.
+	ClickAction string `json:"click_action,omitempty"`
+	// ChannelID selects the Android notification channel (importance, sound, etc).
+	ChannelID string `json:"channel_id,omitempty"`
+	// Tag replaces any previous notification carrying the same tag instead of stacking.
+	Tag string `json:"tag,omitempty"`
+	// NotificationCount sets the Android badge/notification count.
+	NotificationCount int `json:"notification_count,omitempty"`
+
+	// Icon/Badge/Image decorate WebPush notifications only; Android and APNs
+	// payloads don't use them.
+	Icon  string `json:"icon,omitempty"`
+	Badge string `json:"badge,omitempty"`
+	Image string `json:"image,omitempty"`
+
+	// Actions are sent as client-parsed custom data on Android and as native
+	// actions on WebPush. They are not sent in the APNs payload.
+	Actions []Action `json:"actions,omitempty"`
+}
+
+// Action describes a single notification action button, e.g. "reply" or "mark as read".
+type Action struct {
+	// Action is the opaque identifier the client dispatches on when the button is tapped.
+	Action string `json:"action"`
+	Title  string `json:"title"`
+	Icon   string `json:"icon,omitempty"`
+}
@@ -9,6 +9,8 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"sync/atomic"
+	"time"
 
 	fbase "firebase.google.com/go/v4"
 	fbmsg "firebase.google.com/go/v4/messaging"
@@ -19,6 +21,7 @@ import (
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 )
@@ -34,6 +37,9 @@ const (
 
 	// The number of sub/unsub requests sent in one batch. FCM constant.
 	subBatchSize = 1000
+
+	// Default number of batches sent concurrently when the config does not override it.
+	defaultMaxConcurrentBatches = 8
 )
 
 // Handler represents the push handler; implements push.PushHandler interface.
@@ -44,6 +50,17 @@ type Handler struct {
 
 	ctx    context.Context
 	client *fbmsg.Client
+
+	// senderID and tokenSource are used for calls to the FCM REST endpoints
+	// that the messaging.Client doesn't cover, e.g. device group management.
+	senderID    string
+	tokenSource oauth2.TokenSource
+
+	retryQueue *retryQueue
+
+	// Counters for observability. Accessed atomically.
+	sent   int64
+	failed int64
 }
 
 type configType struct {
@@ -56,6 +73,25 @@ type configType struct {
 	Android         *common.Config  `json:"android,omitempty"`
 	Apns            *common.Config  `json:"apns,omitempty"`
 	Webpush         *common.Config  `json:"webpush,omitempty"`
+	// MaxConcurrentBatches caps the number of worker goroutines draining
+	// the input channel, each processing one batch of up to pushBatchSize
+	// messages at a time. Defaults to defaultMaxConcurrentBatches.
+	MaxConcurrentBatches int `json:"max_concurrent_batches,omitempty"`
+
+	// RetryMaxAttempts caps how many times a message that fails with a
+	// transient error is retried before being dropped. Defaults to defaultRetryMaxAttempts.
+	RetryMaxAttempts int `json:"retry_max_attempts,omitempty"`
+	// RetryInitialBackoff is the delay, in milliseconds, before the first retry.
+	// Defaults to defaultRetryInitialBackoff.
+	RetryInitialBackoff int `json:"retry_initial_backoff,omitempty"`
+	// RetryMaxBackoff caps the exponential backoff delay, in milliseconds.
+	// Defaults to defaultRetryMaxBackoff.
+	RetryMaxBackoff int `json:"retry_max_backoff,omitempty"`
+
+	// TokenTTL is, in days, how long a device may go without being seen or
+	// sent a notification before the housekeeping sweep evicts it.
+	// Defaults to defaultTokenTTLDays.
+	TokenTTL int `json:"token_ttl,omitempty"`
 }
 
 // Init initializes the push handler
@@ -87,6 +123,8 @@ func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	handler.senderID = credentials.ProjectID
+	handler.tokenSource = credentials.TokenSource
 
 	app, err := fbase.NewApp(handler.ctx, &fbase.Config{}, option.WithCredentials(credentials))
 	if err != nil {
@@ -100,62 +138,196 @@ func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
 
 	handler.input = make(chan *push.Receipt, bufferSize)
 	handler.channel = make(chan *push.ChannelReq, bufferSize)
-	handler.stop = make(chan bool, 1)
-
-	go func() {
-		for {
-			select {
-			case rcpt := <-handler.input:
-				go sendFcm(rcpt, &config)
-			case sub := <-handler.channel:
-				go processSubscription(sub)
-			case <-handler.stop:
-				return
+	handler.stop = make(chan bool)
+
+	handler.retryQueue = newRetryQueue(&config)
+	go handler.retryQueue.run(handler.stop)
+
+	go runHousekeeping(&config, handler.stop)
+
+	workers := config.MaxConcurrentBatches
+	if workers <= 0 {
+		workers = defaultMaxConcurrentBatches
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case rcpt := <-handler.input:
+					sendFcm(rcpt, &config)
+				case sub := <-handler.channel:
+					processSubscription(sub)
+				case <-handler.stop:
+					return
+				}
 			}
-		}
-	}()
+		}()
+	}
 
 	return true, nil
 }
 
+// sendFcm splits the prepared notifications into FCM-sized batches and sends
+// them one batch at a time on the calling worker goroutine. A receipt
+// targeting a condition expression or a device group is sent as a single
+// message instead of being expanded per-device.
 func sendFcm(rcpt *push.Receipt, config *configType) {
+	if msg, ok := conditionOrGroupMessage(rcpt); ok {
+		applyRichOverrides(msg, rcpt, config)
+		sendOne(msg, config)
+		return
+	}
+
 	messages, uids := PrepareNotifications(rcpt, config)
-	for i := range messages {
-		var err error
-		if config.DryRun {
-			_, err = handler.client.SendDryRun(handler.ctx, messages[i])
-		} else {
-			_, err = handler.client.Send(handler.ctx, messages[i])
+	for _, msg := range messages {
+		applyRichOverrides(msg, rcpt, config)
+	}
+
+	for start := 0; start < len(messages); start += pushBatchSize {
+		end := start + pushBatchSize
+		if end > len(messages) {
+			end = len(messages)
 		}
+		sendBatch(messages[start:end], uids[start:end], config)
+	}
+}
 
-		if err != nil {
-			if fbmsg.IsQuotaExceeded(err) || fbmsg.IsUnavailable(err) || fbmsg.IsInternal(err) {
-				// Transient errors. Stop sending this batch.
-				logs.Warn.Println("fcm transient failure:", err.Error())
-				return
+// sendBatch sends a single batch of up to pushBatchSize messages, preferring
+// SendEachForMulticast when every message in the batch shares the same
+// payload and differs only by target token.
+func sendBatch(messages []*fbmsg.Message, uids []types.Uid, config *configType) {
+	if config.DryRun {
+		// The batch APIs don't support dry-run validation; fall back to
+		// sending each message individually so config errors still surface.
+		for i := range messages {
+			if _, err := handler.client.SendDryRun(handler.ctx, messages[i]); err != nil {
+				logs.Warn.Println("fcm dry run failed:", err.Error())
 			}
-			if fbmsg.IsSenderIDMismatch(err) || fbmsg.IsInvalidArgument(err) || fbmsg.IsThirdPartyAuthError(err) {
-				// Config errors. Stop.
-				logs.Warn.Println("fcm invalid config:", err.Error())
-				return
+		}
+		return
+	}
+
+	var resp *fbmsg.BatchResponse
+	var err error
+	if mcast, ok := asMulticastMessage(messages); ok {
+		resp, err = handler.client.SendEachForMulticast(handler.ctx, mcast)
+	} else {
+		resp, err = handler.client.SendAll(handler.ctx, messages)
+	}
+
+	if err != nil {
+		// The whole batch could not be delivered, e.g. a transport or auth
+		// failure. Individual message errors are reported in resp.Responses
+		// and handled below, so this is always a systemic failure; treat it
+		// as transient and retry every message in the batch.
+		logs.Warn.Println("fcm batch send failed, queuing retry:", err.Error())
+		atomic.AddInt64(&handler.failed, int64(len(messages)))
+		for i := range messages {
+			handler.retryQueue.enqueue(messages[i], uids[i], true, retryAfter(err))
+		}
+		return
+	}
+
+	for i, result := range resp.Responses {
+		if result.Success {
+			atomic.AddInt64(&handler.sent, 1)
+			if derr := store.Devices.MarkNotified(uids[i], messages[i].Token, time.Now()); derr != nil {
+				logs.Warn.Println("fcm failed to update last-notified time:", derr)
 			}
+			continue
+		}
 
-			if fbmsg.IsUnregistered(err) {
-				// Token is no longer valid. Delete token from DB and continue sending.
-				logs.Warn.Println("fcm invalid token:", err.Error())
-				if err := store.Devices.Delete(uids[i], messages[i].Token); err != nil {
-					logs.Warn.Println("fcm failed to delete invalid token:", err)
-				}
-			} else {
-				// Unknown error. Stop sending just in case.
-				logs.Warn.Println("fcm unrecognized error:", err.Error())
-				return
+		atomic.AddInt64(&handler.failed, 1)
+		rerr := result.Error
+		switch {
+		case fbmsg.IsUnregistered(rerr) || fbmsg.IsInvalidArgument(rerr):
+			// Token is no longer valid. Delete it and keep processing the rest of the batch.
+			logs.Warn.Println("fcm invalid token:", rerr.Error())
+			if derr := store.Devices.Delete(uids[i], messages[i].Token); derr != nil {
+				logs.Warn.Println("fcm failed to delete invalid token:", derr)
 			}
+		case fbmsg.IsQuotaExceeded(rerr) || fbmsg.IsUnavailable(rerr) || fbmsg.IsInternal(rerr):
+			// Transient error affecting just this entry. Queue it for a later
+			// retry instead of dropping it; the rest of the batch is unaffected.
+			logs.Warn.Println("fcm transient failure, queuing retry:", rerr.Error())
+			handler.retryQueue.enqueue(messages[i], uids[i], true, retryAfter(rerr))
+		case fbmsg.IsSenderIDMismatch(rerr) || fbmsg.IsThirdPartyAuthError(rerr):
+			logs.Warn.Println("fcm invalid config:", rerr.Error())
+		default:
+			logs.Warn.Println("fcm unrecognized error:", rerr.Error())
+		}
+	}
+}
+
+// asMulticastMessage reports whether all messages share identical content
+// (notification, data, platform overrides, condition) and differ only by
+// Token, in which case they can be collapsed into a single MulticastMessage.
+func asMulticastMessage(messages []*fbmsg.Message) (*fbmsg.MulticastMessage, bool) {
+	if len(messages) == 0 {
+		return nil, false
+	}
+
+	tokens := make([]string, len(messages))
+	first := messages[0]
+	for i, msg := range messages {
+		tokens[i] = msg.Token
+		if msg.Token == "" || msg.Topic != "" || msg.Condition != "" {
+			return nil, false
+		}
+		if i > 0 && !samePayload(first, msg) {
+			return nil, false
 		}
 	}
+
+	return &fbmsg.MulticastMessage{
+		Tokens:       tokens,
+		Data:         first.Data,
+		Notification: first.Notification,
+		Android:      first.Android,
+		Webpush:      first.Webpush,
+		APNS:         first.APNS,
+		FCMOptions:   first.FCMOptions,
+	}, true
+}
+
+// samePayload reports whether two messages are identical except for Token.
+func samePayload(a, b *fbmsg.Message) bool {
+	aCopy, bCopy := *a, *b
+	aCopy.Token, bCopy.Token = "", ""
+	aJSON, err := json.Marshal(aCopy)
+	if err != nil {
+		return false
+	}
+	bJSON, err := json.Marshal(bCopy)
+	if err != nil {
+		return false
+	}
+	return string(aJSON) == string(bJSON)
+}
+
+// Stats returns the cumulative count of successfully and unsuccessfully
+// delivered messages since the handler was initialized.
+func (Handler) Stats() (sent, failed int64) {
+	return atomic.LoadInt64(&handler.sent), atomic.LoadInt64(&handler.failed)
+}
+
+// RetryStats returns the current depth of the transient-failure retry queue
+// along with the cumulative number of retry attempts and messages dropped,
+// either after exhausting retry_max_attempts or because the queue was full.
+func (Handler) RetryStats() (depth, retried, dropped int64) {
+	if handler.retryQueue == nil {
+		return 0, 0, 0
+	}
+	return handler.retryQueue.Stats()
 }
 
 func processSubscription(req *push.ChannelReq) {
+	if req.GroupOp != "" {
+		// Device-group management request, not a topic sub/unsub.
+		handleGroupOp(req)
+		return
+	}
+
 	var channel string
 	var devices []string
 	var device string
@@ -251,7 +423,7 @@ func (Handler) Channel() chan<- *push.ChannelReq {
 
 // Stop shuts down the handler
 func (Handler) Stop() {
-	handler.stop <- true
+	close(handler.stop)
 }
 
 func init() {
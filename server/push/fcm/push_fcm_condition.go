@@ -0,0 +1,60 @@
+package fcm
+
+import (
+	"sync/atomic"
+
+	fbmsg "firebase.google.com/go/v4/messaging"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// conditionOrGroupMessage builds a single *fbmsg.Message for a receipt that
+// targets an FCM condition expression (e.g. "'TopicA' in topics &&
+// 'TopicB' in topics") or a device-group notification key, either of which
+// fan out to many devices server-side without the caller enumerating tokens.
+// The second return value is false when the receipt targets individual
+// devices and should go through the normal PrepareNotifications path instead.
+func conditionOrGroupMessage(rcpt *push.Receipt) (*fbmsg.Message, bool) {
+	if cond := rcpt.Payload.Condition; cond != "" {
+		return &fbmsg.Message{Condition: cond}, true
+	}
+	if key := rcpt.Payload.GroupKey; key != "" {
+		// FCM addresses a device group the same way it addresses a single
+		// token: the notification_key goes in the Token field.
+		return &fbmsg.Message{Token: key}, true
+	}
+	return nil, false
+}
+
+// sendOne sends a single message outside the batch path, used for
+// condition/group targets which FCM only accepts one at a time.
+func sendOne(msg *fbmsg.Message, config *configType) {
+	var err error
+	if config.DryRun {
+		_, err = handler.client.SendDryRun(handler.ctx, msg)
+	} else {
+		_, err = handler.client.Send(handler.ctx, msg)
+	}
+
+	if err == nil {
+		atomic.AddInt64(&handler.sent, 1)
+		return
+	}
+
+	atomic.AddInt64(&handler.failed, 1)
+	switch {
+	case fbmsg.IsQuotaExceeded(err) || fbmsg.IsUnavailable(err) || fbmsg.IsInternal(err):
+		logs.Warn.Println("fcm transient failure sending to condition/group, queuing retry:", err.Error())
+		// Condition/group targets have no owning uid and msg carries an FCM
+		// condition or notification_key, not a device token; isDevice=false
+		// keeps the retry from ever routing through per-device cleanup.
+		handler.retryQueue.enqueue(msg, types.Uid(0), false, retryAfter(err))
+	case fbmsg.IsInvalidArgument(err):
+		// An unknown or malformed condition/notification_key. Nothing to delete; just log.
+		logs.Warn.Println("fcm invalid condition or group key:", err.Error())
+	default:
+		logs.Warn.Println("fcm unrecognized error sending to condition/group:", err.Error())
+	}
+}
@@ -0,0 +1,97 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+)
+
+// notificationKeyURL is the FCM REST endpoint for managing device groups.
+// https://firebase.google.com/docs/cloud-messaging/js/device-group
+const notificationKeyURL = "https://fcm.googleapis.com/fcm/notification"
+
+// groupOpRequest is the body sent to notificationKeyURL.
+type groupOpRequest struct {
+	Operation           string   `json:"operation"`
+	NotificationKeyName string   `json:"notification_key_name"`
+	NotificationKey     string   `json:"notification_key,omitempty"`
+	RegistrationIds     []string `json:"registration_ids"`
+}
+
+type groupOpResponse struct {
+	NotificationKey string `json:"notification_key"`
+	Error           string `json:"error"`
+}
+
+// handleGroupOp creates a device-group notification key, or adds/removes
+// devices in one, on behalf of req.Uid and logs the outcome. The resulting
+// key is only logged; nothing is sent back to the requester.
+func handleGroupOp(req *push.ChannelReq) {
+	key, err := manageDeviceGroup(context.Background(), req.GroupOp, req.GroupKeyName, req.GroupKey, req.Devices)
+	if err != nil {
+		logs.Warn.Println("fcm: device group", req.GroupOp, "failed for", req.Uid.UserId(), ":", err)
+		return
+	}
+	logs.Info.Println("fcm: device group", req.GroupOp, "ok for", req.Uid.UserId(), ", key:", key)
+}
+
+// manageDeviceGroup performs a create/add/remove operation against the
+// FCM notification_key REST API and returns the resulting notification key.
+// op must be one of "create", "add", "remove".
+func manageDeviceGroup(ctx context.Context, op, keyName, notificationKey string, registrationIds []string) (string, error) {
+	if op == "" || keyName == "" || len(registrationIds) == 0 {
+		return "", errors.New("fcm: missing operation, notification_key_name or registration_ids")
+	}
+
+	body, err := json.Marshal(groupOpRequest{
+		Operation:           op,
+		NotificationKeyName: keyName,
+		NotificationKey:     notificationKey,
+		RegistrationIds:     registrationIds,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, notificationKeyURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("project_id", handler.senderID)
+
+	token, err := handler.tokenSource.Token()
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var result groupOpResponse
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return "", errors.New("fcm: malformed device group response: " + string(raw))
+	}
+	if result.Error != "" {
+		return "", errors.New("fcm: device group error: " + result.Error)
+	}
+
+	return result.NotificationKey, nil
+}
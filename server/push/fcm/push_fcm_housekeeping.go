@@ -0,0 +1,95 @@
+package fcm
+
+import (
+	"time"
+
+	fbmsg "firebase.google.com/go/v4/messaging"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+)
+
+const (
+	// defaultTokenTTLDays matches FCM's recommendation to refresh or remove
+	// tokens that haven't been used in about 60 days.
+	defaultTokenTTLDays = 61
+
+	// How often the housekeeping sweep runs.
+	housekeepingInterval = 24 * time.Hour
+
+	// How many still-fresh tokens to dry-run validate on each sweep, to catch
+	// tokens FCM has invalidated without us having tried to send to them.
+	validationSampleSize = 50
+)
+
+// runHousekeeping periodically evicts devices that haven't been seen or sent
+// a notification in token_ttl days, and dry-run-validates a sample of the
+// remaining ones so dead installs are caught even between real sends.
+func runHousekeeping(config *configType, stop <-chan bool) {
+	ttlDays := config.TokenTTL
+	if ttlDays <= 0 {
+		ttlDays = defaultTokenTTLDays
+	}
+	ttl := time.Duration(ttlDays) * 24 * time.Hour
+
+	ticker := time.NewTicker(housekeepingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sweepStaleDevices(ttl)
+			validateTokenSample(config)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweepStaleDevices deletes every device that's neither checked in nor been
+// successfully pushed to since the TTL cutoff (see DeviceGetStale).
+func sweepStaleDevices(ttl time.Duration) {
+	cutoff := time.Now().Add(-ttl)
+
+	uids, tokens, err := store.Devices.GetStale(cutoff)
+	if err != nil {
+		logs.Warn.Println("fcm housekeeping: failed to scan for stale devices:", err)
+		return
+	}
+
+	for i, uid := range uids {
+		if err := store.Devices.Delete(uid, tokens[i]); err != nil {
+			logs.Warn.Println("fcm housekeeping: failed to delete stale device:", err)
+			continue
+		}
+	}
+	if len(uids) > 0 {
+		logs.Info.Println("fcm housekeeping: evicted", len(uids), "stale devices")
+	}
+}
+
+// validateTokenSample dry-run sends to a random sample of this handler's own
+// FCM-registered devices that survived the TTL sweep, evicting any FCM
+// reports as unregistered or invalid. Other providers' devices are excluded:
+// their tokens aren't valid FCM registration tokens, and sending to them
+// would come back invalid and get them wrongly deleted.
+func validateTokenSample(config *configType) {
+	uids, tokens, err := store.Devices.GetSample("fcm", validationSampleSize)
+	if err != nil {
+		logs.Warn.Println("fcm housekeeping: failed to sample devices:", err)
+		return
+	}
+
+	for i, token := range tokens {
+		_, err := handler.client.SendDryRun(handler.ctx, &fbmsg.Message{Token: token})
+		if err == nil {
+			continue
+		}
+		if fbmsg.IsUnregistered(err) || fbmsg.IsInvalidArgument(err) {
+			logs.Warn.Println("fcm housekeeping: evicting invalid token:", err.Error())
+			if derr := store.Devices.Delete(uids[i], token); derr != nil {
+				logs.Warn.Println("fcm housekeeping: failed to delete invalid token:", derr)
+			}
+		}
+	}
+}
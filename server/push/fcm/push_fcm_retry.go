@@ -0,0 +1,256 @@
+package fcm
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fbmsg "firebase.google.com/go/v4/messaging"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	defaultRetryMaxAttempts    = 5
+	defaultRetryInitialBackoff = 1000   // 1s, in milliseconds.
+	defaultRetryMaxBackoff     = 300000 // 5min, in milliseconds.
+
+	// retryQueueCapacity bounds the in-memory ring so a sustained FCM outage
+	// can't grow the queue without limit.
+	retryQueueCapacity = 10000
+
+	// How often the retry goroutine wakes up to check for due items.
+	retryTick = 500 * time.Millisecond
+)
+
+// retryItem is a single message awaiting another delivery attempt.
+type retryItem struct {
+	message  *fbmsg.Message
+	uid      types.Uid
+	attempts int
+	// isDevice is true when message.Token addresses a single registered
+	// device, and false when it addresses an FCM condition expression or
+	// device-group notification key. Condition/group targets have no owning
+	// uid and their Token isn't a device token, so they must never go
+	// through the per-device cleanup path on IsInvalidArgument/IsUnregistered.
+	isDevice  bool
+	notBefore time.Time
+}
+
+// retryQueue holds messages that failed with a transient FCM error and
+// retries them with jittered exponential backoff. It's a simple bounded
+// in-memory ring; on restart any queued retries are lost, which is
+// acceptable since the same transient condition would likely have expired
+// by the time the process comes back up.
+type retryQueue struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mu    sync.Mutex
+	items []retryItem
+
+	// Metrics. Accessed atomically.
+	depth   int64
+	retried int64
+	dropped int64
+}
+
+func newRetryQueue(config *configType) *retryQueue {
+	maxAttempts := config.RetryMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	initialBackoff := config.RetryInitialBackoff
+	if initialBackoff <= 0 {
+		initialBackoff = defaultRetryInitialBackoff
+	}
+	maxBackoff := config.RetryMaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	return &retryQueue{
+		maxAttempts:    maxAttempts,
+		initialBackoff: time.Duration(initialBackoff) * time.Millisecond,
+		maxBackoff:     time.Duration(maxBackoff) * time.Millisecond,
+	}
+}
+
+// enqueue schedules message for a retry after delay. A zero delay means
+// "use the queue's own exponential backoff schedule". isDevice must be true
+// only when message.Token is a real per-device registration token owned by
+// uid; condition/group targets must pass false so a later IsInvalidArgument/
+// IsUnregistered response doesn't trigger a bogus device deletion.
+func (q *retryQueue) enqueue(message *fbmsg.Message, uid types.Uid, isDevice bool, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) >= retryQueueCapacity {
+		atomic.AddInt64(&q.dropped, 1)
+		logs.Warn.Println("fcm retry queue full, dropping message for", uid.UserId())
+		return
+	}
+
+	if delay <= 0 {
+		delay = q.backoff(0)
+	}
+
+	q.items = append(q.items, retryItem{
+		message:   message,
+		uid:       uid,
+		isDevice:  isDevice,
+		notBefore: time.Now().Add(delay),
+	})
+	atomic.AddInt64(&q.depth, 1)
+}
+
+// backoff computes the jittered exponential delay for the given attempt
+// count (0-based), capped at maxBackoff.
+func (q *retryQueue) backoff(attempts int) time.Duration {
+	d := q.initialBackoff
+	for i := 0; i < attempts; i++ {
+		d *= 2
+		if d >= q.maxBackoff {
+			d = q.maxBackoff
+			break
+		}
+	}
+	// +/-20% jitter to avoid synchronized retry storms.
+	jitter := time.Duration(rand.Int63n(int64(d) / 5))
+	if rand.Intn(2) == 0 {
+		if d+jitter > q.maxBackoff {
+			return q.maxBackoff
+		}
+		return d + jitter
+	}
+	return d - jitter
+}
+
+// run drains due items and resends them one at a time until stop is closed.
+func (q *retryQueue) run(stop <-chan bool) {
+	ticker := time.NewTicker(retryTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.retryDue()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (q *retryQueue) retryDue() {
+	now := time.Now()
+
+	q.mu.Lock()
+	var due []retryItem
+	remaining := q.items[:0]
+	for _, item := range q.items {
+		if !item.notBefore.After(now) {
+			due = append(due, item)
+		} else {
+			remaining = append(remaining, item)
+		}
+	}
+	q.items = remaining
+	q.mu.Unlock()
+
+	for _, item := range due {
+		atomic.AddInt64(&q.depth, -1)
+		q.attempt(item)
+	}
+}
+
+func (q *retryQueue) attempt(item retryItem) {
+	atomic.AddInt64(&q.retried, 1)
+
+	_, err := handler.client.Send(handler.ctx, item.message)
+	if err == nil {
+		// This message was already counted into handler.failed when it was
+		// first queued (see sendBatch); count it as sent now that it made it
+		// through, or Stats() permanently under-reports successes for any
+		// message that needed a retry.
+		atomic.AddInt64(&handler.sent, 1)
+		// A message that only succeeds after being requeued here never goes
+		// through sendBatch's success path, so without this the device would
+		// never have LastNotifiedAt touched and would look stale to
+		// housekeeping despite being live.
+		if item.isDevice {
+			if derr := store.Devices.MarkNotified(item.uid, item.message.Token, time.Now()); derr != nil {
+				logs.Warn.Println("fcm retry: failed to update last-notified time:", derr)
+			}
+		}
+		return
+	}
+
+	if fbmsg.IsUnregistered(err) || fbmsg.IsInvalidArgument(err) {
+		logs.Warn.Println("fcm retry: invalid token:", err.Error())
+		if item.isDevice {
+			if derr := store.Devices.Delete(item.uid, item.message.Token); derr != nil {
+				logs.Warn.Println("fcm retry: failed to delete invalid token:", derr)
+			}
+		}
+		return
+	}
+
+	if !(fbmsg.IsQuotaExceeded(err) || fbmsg.IsUnavailable(err) || fbmsg.IsInternal(err)) {
+		// No longer transient (e.g. config changed underneath us). Give up.
+		logs.Warn.Println("fcm retry: giving up, non-transient error:", err.Error())
+		return
+	}
+
+	item.attempts++
+	if item.attempts >= q.maxAttempts {
+		atomic.AddInt64(&q.dropped, 1)
+		logs.Warn.Println("fcm retry: giving up after", item.attempts, "attempts:", err.Error())
+		return
+	}
+
+	q.mu.Lock()
+	item.notBefore = time.Now().Add(q.backoffFor(item.attempts, err))
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+	atomic.AddInt64(&q.depth, 1)
+}
+
+// backoffFor honors FCM's Retry-After hint when the error carries one,
+// falling back to the queue's own exponential schedule otherwise.
+func (q *retryQueue) backoffFor(attempts int, err error) time.Duration {
+	if d, ok := retryAfterHint(err); ok {
+		return d
+	}
+	return q.backoff(attempts)
+}
+
+// Stats returns the current queue depth and the cumulative retry/drop counts.
+func (q *retryQueue) Stats() (depth, retried, dropped int64) {
+	return atomic.LoadInt64(&q.depth), atomic.LoadInt64(&q.retried), atomic.LoadInt64(&q.dropped)
+}
+
+// retryAfter is a convenience wrapper used by the enqueue call sites:
+// it returns zero when the error carries no explicit retry hint, letting the
+// queue fall back to its own exponential backoff on first enqueue.
+func retryAfter(err error) time.Duration {
+	d, _ := retryAfterHint(err)
+	return d
+}
+
+// retryAfterHint extracts a server-provided retry delay from a FirebaseError,
+// if one was returned. FCM reports this as a RetryInfo detail on
+// RESOURCE_EXHAUSTED (quota) responses.
+func retryAfterHint(err error) (time.Duration, bool) {
+	ferr, ok := err.(*fbmsg.FirebaseError)
+	if !ok || ferr.Details == nil {
+		return 0, false
+	}
+	if secs, ok := ferr.Details["retryAfterSeconds"].(float64); ok && secs > 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	return 0, false
+}
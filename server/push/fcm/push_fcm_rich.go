@@ -0,0 +1,157 @@
+package fcm
+
+import (
+	"encoding/json"
+
+	fbmsg "firebase.google.com/go/v4/messaging"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+)
+
+// applyRichOverrides layers per-platform decoration from config onto an
+// already-built message: APNs localization/mutable-content/category/thread-id,
+// Android click-action/channel/tag/notification-count, and WebPush
+// notification actions/icon/badge/image. It's a no-op for any platform block
+// left nil in the config. Fields that vary per receipt (the iOS thread-id,
+// localization args) are derived from rcpt.Payload rather than the static
+// config, and every platform merges onto whatever PrepareNotifications
+// already built instead of replacing it, so a pre-existing title/body/badge
+// survives.
+func applyRichOverrides(msg *fbmsg.Message, rcpt *push.Receipt, config *configType) {
+	applyApns(msg, rcpt, config.Apns)
+	applyAndroid(msg, rcpt, config.Android)
+	applyWebpush(msg, rcpt, config.Webpush)
+}
+
+func applyApns(msg *fbmsg.Message, rcpt *push.Receipt, cfg *common.Config) {
+	if cfg == nil {
+		return
+	}
+
+	if msg.APNS == nil {
+		msg.APNS = &fbmsg.APNSConfig{}
+	}
+	if msg.APNS.Payload == nil {
+		msg.APNS.Payload = &fbmsg.APNSPayload{}
+	}
+
+	aps := msg.APNS.Payload.Aps
+	if aps == nil {
+		aps = &fbmsg.Aps{}
+	}
+	if cfg.MutableContent {
+		aps.MutableContent = true
+	}
+	if cfg.Category != "" {
+		aps.Category = cfg.Category
+	}
+	// Thread-id groups related notifications in the iOS notification center;
+	// the tinode topic is what actually identifies "related" here, so it
+	// takes priority over the static config value.
+	if rcpt.Payload.Topic != "" {
+		aps.ThreadID = rcpt.Payload.Topic
+	} else if cfg.ThreadID != "" {
+		aps.ThreadID = cfg.ThreadID
+	}
+
+	if cfg.LocKey != "" || cfg.TitleLocKey != "" {
+		alert := aps.Alert
+		if alert == nil {
+			alert = &fbmsg.ApsAlert{}
+		}
+		locArgs := cfg.LocArgs
+		if len(locArgs) == 0 && rcpt.Payload.Topic != "" {
+			// No static args configured: fall back to the topic so the loc
+			// string can still reference where the message came from.
+			locArgs = []string{rcpt.Payload.Topic}
+		}
+		alert.LocKey = cfg.LocKey
+		alert.LocArgs = locArgs
+		alert.TitleLocKey = cfg.TitleLocKey
+		alert.TitleLocArgs = cfg.TitleLocArgs
+		aps.Alert = alert
+	}
+
+	msg.APNS.Payload.Aps = aps
+}
+
+func applyAndroid(msg *fbmsg.Message, rcpt *push.Receipt, cfg *common.Config) {
+	if cfg == nil {
+		return
+	}
+
+	if msg.Android == nil {
+		msg.Android = &fbmsg.AndroidConfig{}
+	}
+
+	notif := msg.Android.Notification
+	if notif == nil {
+		notif = &fbmsg.AndroidNotification{}
+	}
+	if cfg.ClickAction != "" {
+		notif.ClickAction = cfg.ClickAction
+	}
+	if cfg.ChannelID != "" {
+		notif.ChannelID = cfg.ChannelID
+	}
+	if cfg.Tag != "" {
+		notif.Tag = cfg.Tag
+	}
+	if cfg.NotificationCount != 0 {
+		notif.NotificationCount = cfg.NotificationCount
+	}
+	msg.Android.Notification = notif
+
+	if len(cfg.Actions) > 0 {
+		// AndroidNotification has no native action-button field; the client
+		// reconstructs NotificationCompat.Action entries from this custom data.
+		encoded, err := json.Marshal(cfg.Actions)
+		if err != nil {
+			logs.Warn.Println("fcm: failed to encode android actions:", err)
+			return
+		}
+		if msg.Data == nil {
+			msg.Data = map[string]string{}
+		}
+		msg.Data["actions"] = string(encoded)
+	}
+}
+
+func applyWebpush(msg *fbmsg.Message, rcpt *push.Receipt, cfg *common.Config) {
+	if cfg == nil {
+		return
+	}
+
+	if msg.Webpush == nil {
+		msg.Webpush = &fbmsg.WebpushConfig{}
+	}
+
+	notif := msg.Webpush.Notification
+	if notif == nil {
+		notif = &fbmsg.WebpushNotification{}
+	}
+	if cfg.Icon != "" {
+		notif.Icon = cfg.Icon
+	}
+	for _, a := range cfg.Actions {
+		notif.Actions = append(notif.Actions, &fbmsg.WebpushNotificationAction{
+			Action: a.Action,
+			Title:  a.Title,
+			Icon:   a.Icon,
+		})
+	}
+	if cfg.Badge != "" || cfg.Image != "" {
+		if notif.CustomData == nil {
+			notif.CustomData = map[string]interface{}{}
+		}
+		if cfg.Badge != "" {
+			notif.CustomData["badge"] = cfg.Badge
+		}
+		if cfg.Image != "" {
+			notif.CustomData["image"] = cfg.Image
+		}
+	}
+	msg.Webpush.Notification = notif
+}
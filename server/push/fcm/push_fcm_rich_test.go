@@ -0,0 +1,217 @@
+package fcm
+
+import (
+	"testing"
+
+	fbmsg "firebase.google.com/go/v4/messaging"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+)
+
+func TestApplyApnsLocalizationAndDecoration(t *testing.T) {
+	cfg := &common.Config{
+		LocKey:         "MSG_FROM",
+		LocArgs:        []string{"alice"},
+		TitleLocKey:    "NEW_MSG",
+		MutableContent: true,
+		Category:       "MESSAGE_CATEGORY",
+		ThreadID:       "configured-thread",
+	}
+	rcpt := &push.Receipt{Payload: push.Payload{Topic: "topic1"}}
+
+	msg := &fbmsg.Message{}
+	applyApns(msg, rcpt, cfg)
+
+	if msg.APNS == nil || msg.APNS.Payload == nil || msg.APNS.Payload.Aps == nil {
+		t.Fatal("expected APNS payload to be populated")
+	}
+	aps := msg.APNS.Payload.Aps
+	if !aps.MutableContent {
+		t.Error("expected MutableContent to be true")
+	}
+	if aps.Category != cfg.Category {
+		t.Errorf("Category = %q, want %q", aps.Category, cfg.Category)
+	}
+	// The receipt's topic takes priority over the static config ThreadID.
+	if aps.ThreadID != rcpt.Payload.Topic {
+		t.Errorf("ThreadID = %q, want %q", aps.ThreadID, rcpt.Payload.Topic)
+	}
+	if aps.Alert == nil || aps.Alert.LocKey != cfg.LocKey || aps.Alert.TitleLocKey != cfg.TitleLocKey {
+		t.Errorf("Alert = %+v, want LocKey=%q TitleLocKey=%q", aps.Alert, cfg.LocKey, cfg.TitleLocKey)
+	}
+}
+
+func TestApplyApnsThreadIDFallsBackToConfigWithoutTopic(t *testing.T) {
+	cfg := &common.Config{ThreadID: "configured-thread"}
+	rcpt := &push.Receipt{}
+
+	msg := &fbmsg.Message{}
+	applyApns(msg, rcpt, cfg)
+
+	if msg.APNS.Payload.Aps.ThreadID != cfg.ThreadID {
+		t.Errorf("ThreadID = %q, want %q", msg.APNS.Payload.Aps.ThreadID, cfg.ThreadID)
+	}
+}
+
+func TestApplyApnsLocArgsFallBackToTopic(t *testing.T) {
+	cfg := &common.Config{LocKey: "MSG_FROM"}
+	rcpt := &push.Receipt{Payload: push.Payload{Topic: "topic1"}}
+
+	msg := &fbmsg.Message{}
+	applyApns(msg, rcpt, cfg)
+
+	if got := msg.APNS.Payload.Aps.Alert.LocArgs; len(got) != 1 || got[0] != "topic1" {
+		t.Errorf("LocArgs = %v, want [topic1]", got)
+	}
+}
+
+func TestApplyApnsMergesOntoExistingAps(t *testing.T) {
+	cfg := &common.Config{Category: "MESSAGE_CATEGORY"}
+	rcpt := &push.Receipt{}
+
+	msg := &fbmsg.Message{
+		APNS: &fbmsg.APNSConfig{
+			Payload: &fbmsg.APNSPayload{
+				Aps: &fbmsg.Aps{
+					Badge: intPtr(3),
+					Sound: "default",
+				},
+			},
+		},
+	}
+	applyApns(msg, rcpt, cfg)
+
+	aps := msg.APNS.Payload.Aps
+	if aps.Badge == nil || *aps.Badge != 3 {
+		t.Errorf("expected pre-existing Badge to survive, got %+v", aps.Badge)
+	}
+	if aps.Sound != "default" {
+		t.Errorf("expected pre-existing Sound to survive, got %v", aps.Sound)
+	}
+	if aps.Category != cfg.Category {
+		t.Errorf("Category = %q, want %q", aps.Category, cfg.Category)
+	}
+}
+
+func intPtr(n int) *int { return &n }
+
+func TestApplyApnsNilConfig(t *testing.T) {
+	msg := &fbmsg.Message{}
+	applyApns(msg, &push.Receipt{}, nil)
+	if msg.APNS != nil {
+		t.Error("expected no APNS payload when config is nil")
+	}
+}
+
+func TestApplyAndroidClickActionAndActions(t *testing.T) {
+	cfg := &common.Config{
+		ClickAction:       "OPEN_TOPIC",
+		ChannelID:         "messages",
+		Tag:               "topic1",
+		NotificationCount: 3,
+		Actions: []common.Action{
+			{Action: "reply", Title: "Reply"},
+			{Action: "mark_read", Title: "Mark read"},
+		},
+	}
+	rcpt := &push.Receipt{Payload: push.Payload{Topic: "topic1"}}
+
+	msg := &fbmsg.Message{}
+	applyAndroid(msg, rcpt, cfg)
+
+	if msg.Android == nil || msg.Android.Notification == nil {
+		t.Fatal("expected Android notification to be populated")
+	}
+	notif := msg.Android.Notification
+	if notif.ClickAction != cfg.ClickAction || notif.ChannelID != cfg.ChannelID || notif.Tag != cfg.Tag {
+		t.Errorf("notification = %+v, want ClickAction=%q ChannelID=%q Tag=%q",
+			notif, cfg.ClickAction, cfg.ChannelID, cfg.Tag)
+	}
+	if notif.NotificationCount != cfg.NotificationCount {
+		t.Errorf("NotificationCount = %d, want %d", notif.NotificationCount, cfg.NotificationCount)
+	}
+	if msg.Data["actions"] == "" {
+		t.Error("expected action buttons to be encoded into Data[\"actions\"]")
+	}
+}
+
+func TestApplyAndroidPreservesExistingNotification(t *testing.T) {
+	cfg := &common.Config{Tag: "topic1"}
+	rcpt := &push.Receipt{}
+
+	msg := &fbmsg.Message{
+		Android: &fbmsg.AndroidConfig{
+			Notification: &fbmsg.AndroidNotification{
+				Title: "Bob",
+				Body:  "hello",
+			},
+		},
+	}
+	applyAndroid(msg, rcpt, cfg)
+
+	notif := msg.Android.Notification
+	if notif.Title != "Bob" || notif.Body != "hello" {
+		t.Errorf("expected pre-existing Title/Body to survive, got %+v", notif)
+	}
+	if notif.Tag != cfg.Tag {
+		t.Errorf("Tag = %q, want %q", notif.Tag, cfg.Tag)
+	}
+}
+
+func TestApplyWebpushIconBadgeImageAndActions(t *testing.T) {
+	cfg := &common.Config{
+		Icon:  "icon.png",
+		Badge: "badge.png",
+		Image: "preview.png",
+		Actions: []common.Action{
+			{Action: "reply", Title: "Reply", Icon: "reply.png"},
+		},
+	}
+	rcpt := &push.Receipt{}
+
+	msg := &fbmsg.Message{}
+	applyWebpush(msg, rcpt, cfg)
+
+	if msg.Webpush == nil || msg.Webpush.Notification == nil {
+		t.Fatal("expected Webpush notification to be populated")
+	}
+	notif := msg.Webpush.Notification
+	if notif.Icon != cfg.Icon {
+		t.Errorf("Icon = %q, want %q", notif.Icon, cfg.Icon)
+	}
+	if len(notif.Actions) != 1 || notif.Actions[0].Action != "reply" {
+		t.Errorf("Actions = %+v, want one reply action", notif.Actions)
+	}
+	if notif.CustomData["badge"] != cfg.Badge || notif.CustomData["image"] != cfg.Image {
+		t.Errorf("CustomData = %+v, want badge=%q image=%q", notif.CustomData, cfg.Badge, cfg.Image)
+	}
+}
+
+func TestApplyWebpushPreservesExistingNotification(t *testing.T) {
+	cfg := &common.Config{Icon: "icon.png"}
+	rcpt := &push.Receipt{}
+
+	msg := &fbmsg.Message{
+		Webpush: &fbmsg.WebpushConfig{
+			Notification: &fbmsg.WebpushNotification{Title: "Bob", Body: "hello"},
+		},
+	}
+	applyWebpush(msg, rcpt, cfg)
+
+	notif := msg.Webpush.Notification
+	if notif.Title != "Bob" || notif.Body != "hello" {
+		t.Errorf("expected pre-existing Title/Body to survive, got %+v", notif)
+	}
+	if notif.Icon != cfg.Icon {
+		t.Errorf("Icon = %q, want %q", notif.Icon, cfg.Icon)
+	}
+}
+
+func TestApplyWebpushNilConfig(t *testing.T) {
+	msg := &fbmsg.Message{}
+	applyWebpush(msg, &push.Receipt{}, nil)
+	if msg.Webpush != nil {
+		t.Error("expected no Webpush payload when config is nil")
+	}
+}
@@ -0,0 +1,275 @@
+// Package hms implements a push notification plugin for Huawei Push Kit.
+// It targets Android devices on Huawei Mobile Services (no Google Play
+// Services), which FCM cannot reach.
+// https://developer.huawei.com/consumer/en/doc/HMSCore-References/push-sendapi-0000001050986197
+package hms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// The number of push messages sent in one batch. HMS constant.
+	pushBatchSize = 100
+
+	tokenURL = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+	sendURL  = "https://push-api.cloud.huawei.com/v1/%s/messages:send"
+
+	// tokenExpiryMargin is subtracted from the token's reported expires_in so
+	// a request started just before expiry doesn't race a mid-flight 401.
+	tokenExpiryMargin = 60 * time.Second
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+
+	client *http.Client
+
+	appID     string
+	appSecret string
+
+	mux         sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+type configType struct {
+	Enabled   bool   `json:"enabled"`
+	DryRun    bool   `json:"dry_run"`
+	AppID     string `json:"app_id"`
+	AppSecret string `json:"app_secret"`
+}
+
+// Init initializes the push handler.
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("hms: failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if config.AppID == "" || config.AppSecret == "" {
+		return false, errors.New("hms: missing app_id or app_secret")
+	}
+
+	handler.appID = config.AppID
+	handler.appSecret = config.AppSecret
+	handler.client = &http.Client{Timeout: 10 * time.Second}
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendHms(rcpt, &config)
+			case sub := <-handler.channel:
+				// Huawei Push Kit supports topics, but subscription management is
+				// not yet implemented here. Log and drop.
+				logs.Warn.Println("hms: topic subscriptions not supported, uid", sub.Uid)
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// providerToken returns a cached client-credentials OAuth2 token, fetching a
+// new one only once the previous one is within tokenExpiryMargin of the
+// expires_in Huawei reported for it. Huawei tokens are valid for about an
+// hour; caching this the same way the apns package caches its provider JWT
+// avoids a token-endpoint round trip on every batch.
+func providerToken(ctx context.Context) (string, error) {
+	handler.mux.Lock()
+	defer handler.mux.Unlock()
+
+	if handler.token != "" && time.Now().Before(handler.tokenExpiry) {
+		return handler.token, nil
+	}
+
+	token, expiresIn, err := accessToken(ctx, handler.appID, handler.appSecret)
+	if err != nil {
+		return "", err
+	}
+
+	handler.token = token
+	handler.tokenExpiry = time.Now().Add(time.Duration(expiresIn)*time.Second - tokenExpiryMargin)
+	return token, nil
+}
+
+// accessToken fetches a fresh client-credentials OAuth2 token, as required by
+// the Huawei Push Kit send API, along with its reported validity period.
+func accessToken(ctx context.Context, appID, appSecret string) (string, int, error) {
+	form := "grant_type=client_credentials&client_id=" + appID + "&client_secret=" + appSecret
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, bytes.NewBufferString(form))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", 0, err
+	}
+	if result.AccessToken == "" {
+		return "", 0, errors.New("hms: empty access token in response")
+	}
+	return result.AccessToken, result.ExpiresIn, nil
+}
+
+// hmsMessage mirrors the subset of Huawei's message envelope this handler
+// populates. See PrepareNotifications for how it's built from a push.Receipt.
+type hmsMessage struct {
+	Data         string            `json:"data,omitempty"`
+	Notification *hmsNotification  `json:"notification,omitempty"`
+	Android      *hmsAndroidConfig `json:"android,omitempty"`
+	Token        []string          `json:"token"`
+}
+
+type hmsNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type hmsAndroidConfig struct {
+	CollapseKey int `json:"collapse_key,omitempty"`
+}
+
+type hmsSendRequest struct {
+	ValidateOnly bool       `json:"validate_only"`
+	Message      hmsMessage `json:"message"`
+}
+
+func sendHms(rcpt *push.Receipt, config *configType) {
+	messages, uids := PrepareNotifications(rcpt, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	token, err := providerToken(ctx)
+	if err != nil {
+		logs.Warn.Println("hms: failed to obtain access token:", err)
+		return
+	}
+
+	for start := 0; start < len(messages); start += pushBatchSize {
+		end := start + pushBatchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		sendBatch(ctx, token, messages[start:end], uids[start:end], config)
+	}
+}
+
+func sendBatch(ctx context.Context, token string, messages []hmsMessage, uids []types.Uid, config *configType) {
+	for i, msg := range messages {
+		body, err := json.Marshal(hmsSendRequest{ValidateOnly: config.DryRun, Message: msg})
+		if err != nil {
+			logs.Warn.Println("hms: failed to marshal message:", err)
+			continue
+		}
+
+		url := fmt.Sprintf(sendURL, handler.appID)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			logs.Warn.Println("hms: failed to build request:", err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := handler.client.Do(req)
+		if err != nil {
+			logs.Warn.Println("hms: send failed:", err)
+			continue
+		}
+
+		var result struct {
+			Code string `json:"code"`
+			Msg  string `json:"msg"`
+		}
+		derr := json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if derr != nil {
+			logs.Warn.Println("hms: failed to decode response:", derr)
+			continue
+		}
+
+		switch result.Code {
+		case "80000000":
+			// Success.
+		case "80300007", "80300008":
+			// Invalid or unregistered token.
+			logs.Warn.Println("hms invalid token:", result.Msg)
+			if len(msg.Token) > 0 {
+				if derr := store.Devices.Delete(uids[i], msg.Token[0]); derr != nil {
+					logs.Warn.Println("hms failed to delete invalid token:", derr)
+				}
+			}
+		default:
+			logs.Warn.Println("hms send error:", result.Code, result.Msg)
+		}
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices. Topic
+// subscriptions are not managed by this handler, so requests received here
+// are logged and dropped.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler.
+func (Handler) Stop() {
+	close(handler.stop)
+}
+
+func init() {
+	push.Register("hms", &handler)
+}
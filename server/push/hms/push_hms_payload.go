@@ -0,0 +1,46 @@
+package hms
+
+import (
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// PrepareNotifications builds one hmsMessage per device registered with the
+// "hms" provider among rcpt's recipients, pairing each message with the
+// owning Uid so a delivery failure can be mapped back to the right device.
+func PrepareNotifications(rcpt *push.Receipt, config *configType) ([]hmsMessage, []types.Uid) {
+	uids := make([]types.Uid, 0, len(rcpt.To))
+	for uid := range rcpt.To {
+		uids = append(uids, uid)
+	}
+
+	devicesByUser, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		return nil, nil
+	}
+
+	title, body := alertText(rcpt)
+
+	var messages []hmsMessage
+	var owners []types.Uid
+	for i, uid := range uids {
+		for _, dev := range devicesByUser[i] {
+			if dev.Provider != "hms" {
+				continue
+			}
+			messages = append(messages, hmsMessage{
+				Token:        []string{dev.DeviceId},
+				Notification: &hmsNotification{Title: title, Body: body},
+			})
+			owners = append(owners, uid)
+		}
+	}
+
+	return messages, owners
+}
+
+// alertText renders the notification title/body shown on the device.
+func alertText(rcpt *push.Receipt) (string, string) {
+	return rcpt.Payload.Topic, "New message"
+}
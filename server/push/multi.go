@@ -0,0 +1,200 @@
+// Package push defines generic types for sending push notifications and keeps
+// the registry of provider-specific handlers (fcm, hms, apns, webpush, ...).
+package push
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// multiBufferSize is the size of the MultiHandler's own input/channel buffers.
+// It's independent of the per-provider handlers' buffers.
+const multiBufferSize = 1024
+
+// Config is one named entry of the `push` config array, e.g.
+//
+//	{"name": "fcm", "config": {...}}
+type Config struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+// MultiHandler implements PushHandler by fanning a single Receipt or
+// ChannelReq out to the provider-specific handler that owns each recipient's
+// device, keyed by types.DeviceDef.Provider (e.g. "fcm", "hms", "apns",
+// "webpush"). A device with no Provider set is treated as "fcm" for backward
+// compatibility with configs written before providers were pluggable.
+type MultiHandler struct {
+	handlers map[string]PushHandler
+
+	input   chan *Receipt
+	channel chan *ChannelReq
+	stop    chan bool
+}
+
+// NewMultiHandler creates a MultiHandler fronting the given named providers.
+// Handlers are expected to already be registered with Register under the
+// same names used in the `push` config array.
+func NewMultiHandler(handlers map[string]PushHandler) *MultiHandler {
+	return &MultiHandler{handlers: handlers}
+}
+
+// Init initializes every configured provider in turn. The jsonconf is an
+// array of Config entries rather than a single provider's config block.
+func (mh *MultiHandler) Init(jsonconf json.RawMessage) (bool, error) {
+	var configs []Config
+	if err := json.Unmarshal(jsonconf, &configs); err != nil {
+		return false, errors.New("push multi: failed to parse config: " + err.Error())
+	}
+
+	ready := false
+	for _, entry := range configs {
+		h, ok := mh.handlers[entry.Name]
+		if !ok {
+			logs.Warn.Println("push multi: no handler registered for", entry.Name)
+			continue
+		}
+		ok, err := h.Init(entry.Config)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			ready = true
+		} else {
+			// Provider present in the binary but disabled in config.
+			delete(mh.handlers, entry.Name)
+		}
+	}
+
+	if !ready {
+		return false, nil
+	}
+
+	mh.input = make(chan *Receipt, multiBufferSize)
+	mh.channel = make(chan *ChannelReq, multiBufferSize)
+	mh.stop = make(chan bool)
+
+	go mh.run()
+
+	return true, nil
+}
+
+func (mh *MultiHandler) run() {
+	for {
+		select {
+		case rcpt := <-mh.input:
+			mh.dispatchReceipt(rcpt)
+		case req := <-mh.channel:
+			mh.dispatchChannelReq(req)
+		case <-mh.stop:
+			return
+		}
+	}
+}
+
+// providerOf returns the device's provider, defaulting to "fcm" for devices
+// registered before per-device providers existed.
+func providerOf(dev types.DeviceDef) string {
+	if dev.Provider == "" {
+		return "fcm"
+	}
+	return dev.Provider
+}
+
+// dispatchReceipt splits rcpt into one Receipt per provider, containing only
+// the recipients that have at least one device registered with that
+// provider, then forwards each split receipt to the owning handler.
+func (mh *MultiHandler) dispatchReceipt(rcpt *Receipt) {
+	uids := make([]types.Uid, 0, len(rcpt.To))
+	for uid := range rcpt.To {
+		uids = append(uids, uid)
+	}
+
+	devicesByUser, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("push multi: failed to load devices:", err)
+		return
+	}
+
+	perProvider := make(map[string]*Receipt)
+	for i, uid := range uids {
+		for _, dev := range devicesByUser[i] {
+			name := providerOf(dev)
+			if _, registered := mh.handlers[name]; !registered {
+				continue
+			}
+			sub, ok := perProvider[name]
+			if !ok {
+				sub = &Receipt{To: make(map[types.Uid]Recipient), Payload: rcpt.Payload}
+				perProvider[name] = sub
+			}
+			sub.To[uid] = rcpt.To[uid]
+		}
+	}
+
+	for name, sub := range perProvider {
+		select {
+		case mh.handlers[name].Push() <- sub:
+		default:
+			logs.Warn.Println("push multi: dropped receipt, handler busy:", name)
+		}
+	}
+}
+
+// dispatchChannelReq forwards a topic sub/unsub request to every provider
+// that owns at least one of the user's devices. Providers without topic
+// support (e.g. direct APNs) are expected to ignore requests they can't act on.
+func (mh *MultiHandler) dispatchChannelReq(req *ChannelReq) {
+	devices, err := store.Devices.GetAll(req.Uid)
+	if err != nil || len(devices) == 0 {
+		return
+	}
+
+	sent := make(map[string]bool)
+	for _, dev := range devices[0] {
+		name := providerOf(dev)
+		if sent[name] {
+			continue
+		}
+		h, ok := mh.handlers[name]
+		if !ok {
+			continue
+		}
+		sent[name] = true
+		select {
+		case h.Channel() <- req:
+		default:
+			logs.Warn.Println("push multi: dropped sub request, handler busy:", name)
+		}
+	}
+}
+
+// IsReady returns true once at least one provider initialized successfully.
+func (mh *MultiHandler) IsReady() bool {
+	return mh.input != nil
+}
+
+// Push returns the channel the server uses to submit receipts for delivery.
+func (mh *MultiHandler) Push() chan<- *Receipt {
+	return mh.input
+}
+
+// Channel returns the channel used for topic sub/unsub requests.
+func (mh *MultiHandler) Channel() chan<- *ChannelReq {
+	return mh.channel
+}
+
+// Stop shuts down the dispatcher and every provider it fronts.
+func (mh *MultiHandler) Stop() {
+	close(mh.stop)
+	for _, h := range mh.handlers {
+		// Registered handlers not named in the config were never initialized.
+		if h.IsReady() {
+			h.Stop()
+		}
+	}
+}
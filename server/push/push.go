@@ -0,0 +1,112 @@
+// Package push defines the generic types used to send push notifications and
+// keeps the registry of provider-specific handlers (fcm, hms, apns, webpush, ...).
+package push
+
+import (
+	"encoding/json"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Payload is the provider-agnostic description of what a push notification
+// is about. Provider handlers translate it into their own wire format
+// (fbmsg.Message for FCM, the Huawei/APNs JSON envelopes, ...).
+type Payload struct {
+	// Topic is the tinode topic the triggering message was posted to.
+	Topic string `json:"topic,omitempty"`
+
+	// Condition is an FCM condition expression, e.g. "'A' in topics && 'B'
+	// in topics". When set, the receipt is sent as a single message against
+	// this condition instead of being expanded per device.
+	Condition string `json:"condition,omitempty"`
+	// GroupKey is an FCM device-group notification_key. When set, the
+	// receipt is sent as a single message against this key instead of
+	// being expanded per device.
+	GroupKey string `json:"group_key,omitempty"`
+}
+
+// Recipient carries per-user bookkeeping for a single entry in a Receipt's
+// fan-out list.
+type Recipient struct {
+	// Unread is the recipient's total unread message count across all
+	// topics, used to set platform badge counts.
+	Unread int
+}
+
+// Receipt describes a single push notification: the same Payload delivered
+// to every user in To.
+type Receipt struct {
+	To      map[types.Uid]Recipient
+	Payload Payload
+}
+
+// ChannelReq is a request sent over a handler's Channel(): either a topic
+// subscribe/unsubscribe, or an FCM device-group management request.
+type ChannelReq struct {
+	Uid types.Uid
+
+	// Channel and DeviceID together describe a topic (de)subscription: set
+	// Channel to push all of Uid's devices into one topic, or DeviceID to
+	// push one device into all of Uid's topics.
+	Channel  string
+	DeviceID string
+	Unsub    bool
+
+	// GroupOp, when non-empty, turns this into an FCM device-group
+	// management request instead of a topic sub/unsub: one of "create",
+	// "add", "remove". GroupKeyName/GroupKey/Devices are the
+	// notification_key_name, the existing notification_key (empty on
+	// create), and the registration tokens to add/remove.
+	GroupOp      string
+	GroupKeyName string
+	GroupKey     string
+	Devices      []string
+}
+
+// PushHandler is the interface implemented by every provider-specific push
+// backend (fcm, hms, apns, webpush, ...) and by MultiHandler, which fronts
+// several of them at once.
+type PushHandler interface {
+	// Init initializes the handler from its config block, returning whether
+	// it's enabled.
+	Init(jsonconf json.RawMessage) (bool, error)
+	// IsReady reports whether Init completed successfully.
+	IsReady() bool
+	// Push returns the channel used to submit receipts for delivery.
+	Push() chan<- *Receipt
+	// Channel returns the channel used for topic sub/unsub and device-group
+	// management requests.
+	Channel() chan<- *ChannelReq
+	// Stop shuts the handler down.
+	Stop()
+}
+
+// handlers is the registry of provider handlers keyed by config name,
+// populated by each provider package's init() via Register.
+var handlers = make(map[string]PushHandler)
+
+// Register adds a provider handler to the registry under name, so it can be
+// picked up by Init when it builds the active handler (or MultiHandler) from
+// the server's `push` config.
+func Register(name string, handler PushHandler) {
+	handlers[name] = handler
+}
+
+// Init builds the active push handler from the server's `push` config block:
+// a JSON array of Config entries, one per provider to enable (see Config).
+// Every entry is matched against the registry populated by Register and
+// initialized through a MultiHandler, which then routes each outgoing
+// Receipt/ChannelReq to the provider owning the recipient device, keyed by
+// types.DeviceDef.Provider. It returns nil, nil if no entry produced an
+// enabled handler.
+func Init(jsonconf json.RawMessage) (PushHandler, error) {
+	mh := NewMultiHandler(handlers)
+	ok, err := mh.Init(jsonconf)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	return mh, nil
+}
@@ -0,0 +1,17 @@
+package store
+
+import "github.com/tinode/chat/server/logs"
+
+// RunProviderMigration backfills the Provider field introduced on
+// types.DeviceDef for the pluggable push registry: every device record saved
+// before this migration has Provider == "" and was implicitly FCM-only. Call
+// this once after deploying the multi-provider push config, e.g. from the
+// server's --upgrade-db startup path.
+func RunProviderMigration() error {
+	n, err := Devices.SetDefaultProvider("fcm")
+	if err != nil {
+		return err
+	}
+	logs.Info.Println("store: backfilled provider=fcm on", n, "device records")
+	return nil
+}
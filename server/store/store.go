@@ -0,0 +1,122 @@
+// Package store provides persistence for server state. This snapshot only
+// carries the slice the push subsystem depends on: the registered-device
+// store backing topic subscriptions and push delivery bookkeeping.
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// adp is the active storage adapter (RethinkDB, MySQL, MongoDB, Postgres,
+// ...). It's assigned during server startup; this snapshot only declares the
+// subset of the Adapter interface that the Devices mapper needs.
+var adp Adapter
+
+// Adapter is the subset of the storage backend interface the Devices mapper
+// depends on. The full Adapter interface (users, topics, messages, ...)
+// lives in the adapters this snapshot doesn't carry.
+type Adapter interface {
+	// DeviceUpsert inserts or updates a device record for uid, matching on
+	// DeviceId.
+	DeviceUpsert(uid types.Uid, dev *types.DeviceDef) error
+	// DeviceDelete removes deviceID from uid's device list. If deviceID is
+	// empty, every device belonging to uid is removed.
+	DeviceDelete(uid types.Uid, deviceID string) error
+	// DeviceGetAll returns, for each requested uid in order, the devices
+	// registered to that user.
+	DeviceGetAll(uids ...types.Uid) ([][]types.DeviceDef, error)
+	// DeviceTouchLastNotified updates just the LastNotifiedAt timestamp for
+	// a single device, without touching any other field.
+	DeviceTouchLastNotified(uid types.Uid, deviceID string, when time.Time) error
+	// DeviceGetStale returns every device across all users that is stale as
+	// of cutoff, for housekeeping eviction. A device counts as stale only
+	// when BOTH LastSeen and LastNotifiedAt predate cutoff — i.e. the
+	// comparison is max(LastSeen, LastNotifiedAt) < cutoff, not LastSeen
+	// alone, so a device that's still receiving pushes successfully isn't
+	// evicted just because it hasn't checked in recently.
+	DeviceGetStale(cutoff time.Time) ([]types.Uid, []string, error)
+	// DeviceGetSample returns up to size devices registered with provider,
+	// chosen at random, for that provider's token-validation spot check. A
+	// provider must never be handed another provider's device tokens: they
+	// aren't valid input to its send API and a "invalid token" response
+	// would wrongly evict a live device.
+	DeviceGetSample(provider string, size int) ([]types.Uid, []string, error)
+	// DeviceSetDefaultProvider backfills an empty Provider field with
+	// defaultProvider on every device record that predates the multi-provider
+	// push registry, and returns the number of records updated.
+	DeviceSetDefaultProvider(defaultProvider string) (int, error)
+}
+
+// DevicesObjMapper exposes device-record persistence to the rest of the
+// server. It's a thin wrapper around the active Adapter so callers (the push
+// handlers) don't need to know which backend is configured.
+type DevicesObjMapper struct{}
+
+// Devices is the package-wide device store, analogous to Users/Topics/etc.
+var Devices DevicesObjMapper
+
+// Update inserts or updates a device record for uid.
+func (DevicesObjMapper) Update(uid types.Uid, dev *types.DeviceDef) error {
+	if adp == nil {
+		return errors.New("store: no adapter configured")
+	}
+	return adp.DeviceUpsert(uid, dev)
+}
+
+// Delete removes deviceID from uid's registered devices.
+func (DevicesObjMapper) Delete(uid types.Uid, deviceID string) error {
+	if adp == nil {
+		return errors.New("store: no adapter configured")
+	}
+	return adp.DeviceDelete(uid, deviceID)
+}
+
+// GetAll returns the devices registered to each of uids, in the same order.
+func (DevicesObjMapper) GetAll(uids ...types.Uid) ([][]types.DeviceDef, error) {
+	if adp == nil {
+		return nil, errors.New("store: no adapter configured")
+	}
+	return adp.DeviceGetAll(uids...)
+}
+
+// MarkNotified records that a push was just successfully delivered to
+// uid's deviceID, so housekeeping doesn't evict it as stale.
+func (DevicesObjMapper) MarkNotified(uid types.Uid, deviceID string, when time.Time) error {
+	if adp == nil {
+		return errors.New("store: no adapter configured")
+	}
+	return adp.DeviceTouchLastNotified(uid, deviceID, when)
+}
+
+// GetStale returns every device across all users that's stale as of cutoff:
+// neither checked in nor successfully pushed to since then. See
+// Adapter.DeviceGetStale for the exact comparison.
+func (DevicesObjMapper) GetStale(cutoff time.Time) ([]types.Uid, []string, error) {
+	if adp == nil {
+		return nil, nil, errors.New("store: no adapter configured")
+	}
+	return adp.DeviceGetStale(cutoff)
+}
+
+// GetSample returns up to size devices registered with provider, chosen at
+// random, for spot-checking that provider's token validity between real sends.
+func (DevicesObjMapper) GetSample(provider string, size int) ([]types.Uid, []string, error) {
+	if adp == nil {
+		return nil, nil, errors.New("store: no adapter configured")
+	}
+	return adp.DeviceGetSample(provider, size)
+}
+
+// SetDefaultProvider backfills every device record with an empty Provider
+// to defaultProvider. It's meant to be run once, from a database migration,
+// when upgrading a deployment from single-provider (FCM-only) push config to
+// the pluggable provider registry.
+func (DevicesObjMapper) SetDefaultProvider(defaultProvider string) (int, error) {
+	if adp == nil {
+		return 0, errors.New("store: no adapter configured")
+	}
+	return adp.DeviceSetDefaultProvider(defaultProvider)
+}
@@ -0,0 +1,61 @@
+// Package types defines data structures shared between the store adapters
+// and the rest of the server, including the subset this push subsystem
+// snapshot depends on: user identifiers and registered-device records.
+package types
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// Uid is a unique user ID.
+type Uid uint64
+
+// ZeroUid is an empty/invalid Uid.
+const ZeroUid Uid = 0
+
+// String returns the base64-encoded wire representation of the Uid.
+func (uid Uid) String() string {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(uid))
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(buf), "=")
+}
+
+// UserId returns the string representation of the Uid as used in topic
+// names and API responses, e.g. "usrAbCd123".
+func (uid Uid) UserId() string {
+	if uid == ZeroUid {
+		return ""
+	}
+	return "usr" + uid.String()
+}
+
+// IsZero reports whether the Uid is the zero value.
+func (uid Uid) IsZero() bool {
+	return uid == ZeroUid
+}
+
+// DeviceDef is a registered push notification target: one app install on
+// one device, belonging to one user.
+type DeviceDef struct {
+	// DeviceId is the provider-specific registration token (FCM/HMS
+	// registration token, APNs device token, WebPush endpoint, ...).
+	DeviceId string
+	// Platform is the client platform: "android", "ios", "web".
+	Platform string
+	// Lang is the client's negotiated language, e.g. "en-US".
+	Lang string
+	// LastSeen is when the device last checked in (logged in, refreshed its
+	// token, etc).
+	LastSeen time.Time
+	// LastNotifiedAt is when a push was last successfully delivered to this
+	// device. Used by housekeeping to distinguish idle-but-live devices from
+	// genuinely stale ones.
+	LastNotifiedAt time.Time
+	// Provider is the push backend this device is routed through: "fcm"
+	// (default when empty, for devices registered before providers were
+	// pluggable), "hms", "apns", or "webpush".
+	Provider string
+}